@@ -1,325 +1,615 @@
 package transform
 
 import (
-	"bytes"
 	bp "github.com/spf13/hugo/bufferpool"
+	"io"
 	"net/url"
 	"strings"
 	"sync"
-	"unicode/utf8"
 )
 
-// position (in bytes)
-type pos int
-
-type matchState int
-
-const (
-	matchStateNone matchState = iota
-	matchStateWhitespace
-	matchStatePartial
-	matchStateFull
-)
-
-type item struct {
-	typ itemType
-	pos pos
-	val []byte
+// acNode is one state of an Aho-Corasick trie: a set of goto edges keyed
+// by byte, a fail edge to the longest proper suffix state that is also a
+// trie state, and the set of patterns (by id) that end at this state,
+// including those inherited from its fail chain.
+type acNode struct {
+	children map[byte]*acNode
+	fail     *acNode
+	output   []int
 }
 
-type itemType int
-
-const (
-	tText itemType = iota
-
-	// matches
-	tSrcdq
-	tHrefdq
-	tSrcsq
-	tHrefsq
-	// guards
-	tGrcdq
-	tGhrefdq
-	tGsrcsq
-	tGhrefsq
-)
-
-type contentlexer struct {
-	content []byte
-
-	pos   pos // input position
-	start pos // item start position
-	width pos // width of last element
-
-	matchers     []absurlMatcher
-	state        stateFunc
-	prefixLookup *prefixes
-
-	// items delivered to client
-	items []item
+// next follows a goto edge for b, falling back through fail links (and
+// ultimately to root) exactly like a classic Aho-Corasick automaton.
+func (n *acNode) next(root *acNode, b byte) *acNode {
+	for {
+		if c := n.children[b]; c != nil {
+			return c
+		}
+		if n == root {
+			return root
+		}
+		n = n.fail
+	}
 }
 
-type stateFunc func(*contentlexer) stateFunc
-
-type prefixRunes []rune
+// acAutomaton is a precomputed Aho-Corasick automaton over a fixed set of
+// byte patterns. Building it is O(sum of pattern lengths); scanning
+// content against it is a single left-to-right pass, O(len(content)).
+type acAutomaton struct {
+	root *acNode
+}
 
-type prefixes struct {
-	pr   []prefixRunes
-	curr prefixRunes // current prefix lookup table
-	i    int         // current index
+// buildAC constructs an acAutomaton recognizing all of patterns, indexed
+// by their position in the slice. Patterns that are a prefix of another
+// pattern (as match is of guard, below) simply end at an earlier state on
+// the same root-to-leaf path; both are reported in a single pass as the
+// scan walks through them.
+func buildAC(patterns [][]byte) *acAutomaton {
+	root := &acNode{children: make(map[byte]*acNode)}
+
+	for id, p := range patterns {
+		n := root
+		for _, b := range p {
+			c := n.children[b]
+			if c == nil {
+				c = &acNode{children: make(map[byte]*acNode)}
+				n.children[b] = c
+			}
+			n = c
+		}
+		n.output = append(n.output, id)
+	}
 
-	// first rune in potential match
-	first rune
+	var queue []*acNode
+	for _, c := range root.children {
+		c.fail = root
+		queue = append(queue, c)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
 
-	// match-state:
-	// none, whitespace, partial, full
-	ms matchState
-}
+		for b, c := range n.children {
+			queue = append(queue, c)
 
-// match returns partial and full match for the prefix in play
-// - it's a full match if all prefix runes has checked out in row
-// - it's a partial match if it's on its way towards a full match
-func (l *contentlexer) match(r rune) {
-	p := l.prefixLookup
-	if p.curr == nil {
-		// assumes prefixes all start off on a different rune
-		// works in this special case: href, src
-		p.i = 0
-		for _, pr := range p.pr {
-			if pr[p.i] == r {
-				fullMatch := len(p.pr) == 1
-				p.first = r
-				if !fullMatch {
-					p.curr = pr
-					l.prefixLookup.ms = matchStatePartial
-				} else {
-					l.prefixLookup.ms = matchStateFull
-				}
-				return
+			f := n.fail
+			for f != nil && f.children[b] == nil {
+				f = f.fail
 			}
-		}
-	} else {
-		p.i++
-		if p.curr[p.i] == r {
-			fullMatch := len(p.curr) == p.i+1
-			if fullMatch {
-				p.curr = nil
-				l.prefixLookup.ms = matchStateFull
+			if f == nil {
+				c.fail = root
 			} else {
-				l.prefixLookup.ms = matchStatePartial
+				c.fail = f.children[b]
 			}
-			return
+			c.output = append(c.output, c.fail.output...)
 		}
-
-		p.curr = nil
 	}
 
-	l.prefixLookup.ms = matchStateNone
+	return &acAutomaton{root: root}
 }
 
-func (l *contentlexer) emit(t itemType) {
-	l.items = append(l.items, item{t, l.start, l.content[l.start:l.pos]})
-	l.start = l.pos
-}
+// absurlMatcher is one root-relative URL candidate an absurlReplacer
+// looks for: match is the full byte pattern identifying the candidate
+// (e.g. ` src="/`), guard is the longer pattern identifying a value that
+// is already absolute or protocol-relative (e.g. ` src="//`, which must
+// not be rewritten), and replacement/valueReplacement are what a
+// non-guarded match is rewritten to.
+type absurlMatcher struct {
+	match []byte
+	guard []byte
 
-var mainPrefixRunes = []prefixRunes{{'s', 'r', 'c', '='}, {'h', 'r', 'e', 'f', '='}}
+	// replacement is written in place of match, including its quote byte
+	// or entity.
+	replacement []byte
 
-var itemSlicePool = &sync.Pool{
-	New: func() interface{} {
-		return make([]item, 0, 8)
-	},
-}
+	// valueReplacement is replacement without its leading quote/entity;
+	// used for the second and later URL candidates of a multiVal
+	// attribute, which aren't preceded by a fresh quote.
+	valueReplacement []byte
 
-func replace(content []byte, matchers []absurlMatcher) *contentlexer {
-	var items []item
-	if x := itemSlicePool.Get(); x != nil {
-		items = x.([]item)[:0]
-		defer itemSlicePool.Put(items)
-	} else {
-		items = make([]item, 0, 8)
-	}
+	// quote is the byte that closes this matcher's attribute value ("
+	// or '). Only meaningful (and only consulted) when multiVal is set.
+	quote byte
 
-	lexer := &contentlexer{content: content,
-		items:        items,
-		prefixLookup: &prefixes{pr: mainPrefixRunes},
-		matchers:     matchers}
+	// multiVal marks attributes such as srcset whose value is a
+	// comma-separated list of URL candidates, each of which must be
+	// rewritten independently.
+	multiVal bool
+}
 
-	lexer.runReplacer()
-	return lexer
+// acMeta records which matcher, and whether match or guard, a given
+// automaton pattern id belongs to.
+type acMeta struct {
+	matcherIdx int
+	isGuard    bool
 }
 
-func (l *contentlexer) runReplacer() {
-	for l.state = lexReplacements; l.state != nil; {
-		l.state = l.state(l)
+func buildMatcherAC(matchers []absurlMatcher) (*acAutomaton, []acMeta) {
+	patterns := make([][]byte, 0, len(matchers)*2)
+	metas := make([]acMeta, 0, len(matchers)*2)
+
+	for i, m := range matchers {
+		patterns = append(patterns, m.match)
+		metas = append(metas, acMeta{matcherIdx: i, isGuard: false})
+
+		patterns = append(patterns, m.guard)
+		metas = append(metas, acMeta{matcherIdx: i, isGuard: true})
 	}
+
+	return buildAC(patterns), metas
 }
 
-type absurlMatcher struct {
-	replaceType itemType
-	guardType   itemType
-	match       []byte
-	guard       []byte
-	replacement []byte
-	guarded     bool
+// pendingMatch tracks a match pattern that has just completed and is
+// awaiting the next byte: if it turns out to complete this matcher's
+// guard pattern too (guard is always match plus one more byte), the
+// candidate was already absolute/protocol-relative and the match is
+// dropped instead of replaced. start/end are offsets into the owning
+// streamReplacer's buf.
+type pendingMatch struct {
+	matcherIdx int
+	start      int
+	end        int
 }
 
-func (a absurlMatcher) isSourceType() bool {
-	return a.replaceType == tSrcdq || a.replaceType == tSrcsq
+// streamReplacer is a resumable Aho-Corasick scan: write may be called
+// any number of times with successive, arbitrarily-sized slices of a
+// logical byte stream, and close once at the end, and the result is
+// identical to scanning the whole stream in one call. It carries the
+// automaton's traversal state and any not-yet-resolved match/guard or
+// multiVal candidate across calls instead of restarting from root each
+// time, so a pattern split across two writes is still recognized.
+//
+// Everything written so far that hasn't yet been resolved as plain text
+// or a replacement is kept in buf; buf is compacted as textStart
+// advances, so memory stays bounded by the longest in-flight candidate
+// rather than growing with the stream.
+type streamReplacer struct {
+	matchers  []absurlMatcher
+	automaton *acAutomaton
+	metas     []acMeta
+	holdback  int
+
+	node      *acNode
+	pending   *pendingMatch
+	multiVal  *absurlMatcher
+	buf       []byte
+	textStart int
 }
 
-func lexReplacements(l *contentlexer) stateFunc {
-	contentLength := len(l.content)
-	var r rune
+func newStreamReplacer(matchers []absurlMatcher, automaton *acAutomaton, metas []acMeta, holdback int) *streamReplacer {
+	return &streamReplacer{matchers: matchers, automaton: automaton, metas: metas, holdback: holdback, node: automaton.root}
+}
 
-	for {
-		if int(l.pos) >= contentLength {
-			l.width = 0
-			break
+// write scans p, appended to the stream so far, and writes everything it
+// can conclusively resolve to w. It retains only what might still be
+// part of an in-flight match, guard, or multiVal candidate for the next
+// call.
+func (s *streamReplacer) write(w io.Writer, p []byte) error {
+	offset := len(s.buf)
+	s.buf = append(s.buf, p...)
+
+	if s.multiVal != nil {
+		done, err := s.scanMultiVal(w, *s.multiVal)
+		if err != nil {
+			return err
 		}
-
-		var width int = 1
-		r = rune(l.content[l.pos])
-		if r >= utf8.RuneSelf {
-			r, width = utf8.DecodeRune(l.content[l.pos:])
+		if done {
+			s.multiVal = nil
 		}
-		l.width = pos(width)
-		l.pos += l.width
-
-		if r == ' ' {
-			l.prefixLookup.ms = matchStateWhitespace
-		} else if l.prefixLookup.ms != matchStateNone {
-			l.match(r)
-			if l.prefixLookup.ms == matchStateFull {
-				checkCandidate(l)
+	}
+
+	for i := offset; i < len(s.buf); i++ {
+		s.node = s.node.next(s.automaton.root, s.buf[i])
+		pos := i + 1
+
+		if s.pending != nil && s.pending.end == pos-1 {
+			if guardFollows(s.node, s.metas, s.pending.matcherIdx) {
+				s.pending = nil
+			} else if err := s.commit(w); err != nil {
+				return err
 			}
 		}
 
+		for _, id := range s.node.output {
+			m := s.metas[id]
+			if m.isGuard {
+				continue
+			}
+			matcher := s.matchers[m.matcherIdx]
+			s.pending = &pendingMatch{matcherIdx: m.matcherIdx, start: pos - len(matcher.match), end: pos}
+			break
+		}
 	}
 
-	// Done!
-	if l.pos > l.start {
-		l.emit(tText)
+	if err := s.flushSafe(w); err != nil {
+		return err
 	}
+	s.compact()
 	return nil
 }
 
-func checkCandidate(l *contentlexer) {
-	isSource := l.prefixLookup.first == 's'
-	for _, m := range l.matchers {
-
-		if m.guarded {
-			continue
+// close flushes any remaining buffered content once the stream has
+// ended: a still-pending match can no longer be guarded (there are no
+// more bytes to complete the guard) so it's committed as a replacement,
+// and anything left over after that is plain text.
+func (s *streamReplacer) close(w io.Writer) error {
+	if s.pending != nil {
+		if err := s.commit(w); err != nil {
+			return err
 		}
+	}
+	s.multiVal = nil
+
+	_, err := w.Write(s.buf[s.textStart:])
+	s.buf = s.buf[:0]
+	s.textStart = 0
+	return err
+}
+
+// commit flushes the plain text preceding a confirmed (non-guarded)
+// match, writes its replacement, and starts scanning its attribute value
+// for further multiVal candidates when applicable.
+func (s *streamReplacer) commit(w io.Writer) error {
+	m := s.matchers[s.pending.matcherIdx]
 
-		if isSource && !m.isSourceType() || !isSource && m.isSourceType() {
-			continue
+	if _, err := w.Write(s.buf[s.textStart:s.pending.start]); err != nil {
+		return err
+	}
+	if _, err := w.Write(m.replacement); err != nil {
+		return err
+	}
+	s.textStart = s.pending.end
+	s.pending = nil
+
+	if m.multiVal {
+		done, err := s.scanMultiVal(w, m)
+		if err != nil {
+			return err
 		}
+		if !done {
+			s.multiVal = &m
+		}
+	}
+	return nil
+}
 
-		s := l.content[l.pos:]
-		if bytes.HasPrefix(s, m.guard) {
-			if l.pos > l.start {
-				l.emit(tText)
+// scanMultiVal continues past the first URL candidate of a multi-valued
+// attribute, rewriting every later ", /path" candidate up to the closing
+// quote, since each candidate in srcset="/a.jpg 1x, /b.jpg 2x" must be
+// rewritten independently. It reports done=true once the closing quote
+// has been seen; until then, the value may still be incomplete (split
+// across a chunk boundary) and scanning resumes from textStart on the
+// next call.
+func (s *streamReplacer) scanMultiVal(w io.Writer, m absurlMatcher) (done bool, err error) {
+	i := s.textStart
+	for i < len(s.buf) {
+		if s.buf[i] == m.quote {
+			return true, nil
+		}
+		if s.buf[i] == ',' {
+			j := i + 1
+			for j < len(s.buf) && s.buf[j] == ' ' {
+				j++
 			}
-			l.pos += pos(len(m.guard))
-			l.emit(m.guardType)
-			m.guarded = true
-			return
-		} else if bytes.HasPrefix(s, m.match) {
-			if l.pos > l.start {
-				l.emit(tText)
+			if j >= len(s.buf) {
+				return false, nil
+			}
+			if s.buf[j] == '/' && j+1 >= len(s.buf) {
+				return false, nil
+			}
+			if s.buf[j] == '/' && s.buf[j+1] != '/' {
+				if _, err := w.Write(s.buf[s.textStart:j]); err != nil {
+					return false, err
+				}
+				if _, err := w.Write(m.valueReplacement); err != nil {
+					return false, err
+				}
+				s.textStart = j + 1
+				i = j + 1
+				continue
 			}
-			l.pos += pos(len(m.match))
-			l.emit(m.replaceType)
-			return
-
 		}
+		i++
 	}
+	return false, nil
 }
 
-func doReplace(content []byte, matchers []absurlMatcher) []byte {
-	b := bp.GetBuffer()
-	defer bp.PutBuffer(b)
+// flushSafe writes out everything in buf that couldn't possibly still be
+// part of an unresolved match, guard, or multiVal candidate: the trailing
+// holdback bytes are kept back since a pattern could start within them
+// and complete once more data arrives, and nothing past a pending
+// match's start or an open multiVal value is flushed either.
+func (s *streamReplacer) flushSafe(w io.Writer) error {
+	if s.multiVal != nil {
+		return nil
+	}
 
-	guards := make([]bool, len(matchers))
-	replaced := replace(content, matchers)
+	cut := len(s.buf) - s.holdback
+	if s.pending != nil && s.pending.start < cut {
+		cut = s.pending.start
+	}
+	if cut <= s.textStart {
+		return nil
+	}
 
-	// first pass: check guards
-	for _, item := range replaced.items {
-		if item.typ != tText {
-			for i, e := range matchers {
-				if item.typ == e.guardType {
-					guards[i] = true
-					break
-				}
-			}
-		}
+	if _, err := w.Write(s.buf[s.textStart:cut]); err != nil {
+		return err
 	}
-	// second pass: do replacements for non-guarded tokens
-	for _, token := range replaced.items {
-		switch token.typ {
-		case tText:
-			b.Write(token.val)
-		default:
-			for i, e := range matchers {
-				if token.typ == e.replaceType && !guards[i] {
-					b.Write(e.replacement)
-				} else if token.typ == e.replaceType || token.typ == e.guardType {
-					b.Write(token.val)
-				}
-			}
+	s.textStart = cut
+	return nil
+}
+
+// compact drops the already-written prefix of buf, keeping memory use
+// bounded by the longest in-flight candidate rather than the whole
+// stream scanned so far.
+func (s *streamReplacer) compact() {
+	if s.textStart == 0 {
+		return
+	}
+	s.buf = append(s.buf[:0], s.buf[s.textStart:]...)
+	if s.pending != nil {
+		s.pending.start -= s.textStart
+		s.pending.end -= s.textStart
+	}
+	s.textStart = 0
+}
+
+func guardFollows(node *acNode, metas []acMeta, matcherIdx int) bool {
+	for _, id := range node.output {
+		if m := metas[id]; m.isGuard && m.matcherIdx == matcherIdx {
+			return true
 		}
 	}
+	return false
+}
+
+// acReplace scans content once against automaton, rewriting every
+// non-guarded match emitted by matchers. It's a thin wrapper over
+// streamReplacer that feeds the whole buffer in a single write, so
+// whole-buffer and chunked callers share exactly the same scanning
+// logic and can never disagree on a result.
+func acReplace(content []byte, matchers []absurlMatcher, automaton *acAutomaton, metas []acMeta) []byte {
+	b := bp.GetBuffer()
+	defer bp.PutBuffer(b)
+
+	s := newStreamReplacer(matchers, automaton, metas, len(content))
+	_ = s.write(b, content)
+	_ = s.close(b)
 
 	return b.Bytes()
 }
 
+// RewriteMode selects how a root-relative URL (e.g. "/a.jpg") is rewritten
+// by an absurlReplacer.
+type RewriteMode int
+
+const (
+	// RewriteModeAbsolute rewrites a root-relative URL to an absolute
+	// URL against the configured base, e.g. "/a.jpg" becomes
+	// "http://example.com/a.jpg". This is the default and matches
+	// Hugo's historical behaviour.
+	RewriteModeAbsolute RewriteMode = iota
+
+	// RewriteModeProtocolRelative rewrites a root-relative URL to a
+	// protocol-relative URL, e.g. "/a.jpg" becomes "//example.com/a.jpg".
+	RewriteModeProtocolRelative
+
+	// RewriteModeCanonical only rewrites a root-relative URL when
+	// AbsURLConfig.BaseURL and AbsURLConfig.CanonicalURL share a host,
+	// leaving it untouched otherwise. This lets the same rendered output
+	// be republished under several base URLs: root-relative links keep
+	// working everywhere, and are only absolutified for the host they
+	// are canonical for (e.g. feeds, where a relative link is invalid).
+	// An empty CanonicalURL is treated as sharing the host, so every
+	// root-relative URL is rewritten.
+	RewriteModeCanonical
+)
+
+// DefaultRewriteAttrs is the attribute set used when AbsURLConfig.Attrs is
+// left empty, matching Hugo's historical behaviour of only rewriting
+// "src" and "href".
+var DefaultRewriteAttrs = []string{"src", "href"}
+
+// multiValAttrs is the subset of the known attribute set whose value is a
+// comma-separated list of URL candidates rather than a single URL.
+var multiValAttrs = map[string]bool{
+	"srcset": true,
+}
+
+// AbsURLConfig configures an absurlReplacer.
+type AbsURLConfig struct {
+	// BaseURL is the absolute base URL root-relative URLs are rewritten
+	// against, e.g. "http://example.com/blog".
+	BaseURL string
+
+	// CanonicalURL is the base URL this rendering is canonical for. It
+	// is only consulted in RewriteModeCanonical.
+	CanonicalURL string
+
+	// Mode selects how a root-relative URL is rewritten. Defaults to
+	// RewriteModeAbsolute.
+	Mode RewriteMode
+
+	// Attrs is the set of HTML/XML attributes whose root-relative URL
+	// value(s) should be rewritten, e.g. []string{"src", "href",
+	// "srcset", "data-src"}. Defaults to DefaultRewriteAttrs when nil.
+	Attrs []string
+}
+
 type absurlReplacer struct {
 	htmlMatchers []absurlMatcher
 	xmlMatchers  []absurlMatcher
-}
 
-func newAbsurlReplacer(baseUrl string) *absurlReplacer {
-	u, _ := url.Parse(baseUrl)
-	base := strings.TrimRight(u.String(), "/")
+	htmlOnce sync.Once
+	htmlAC   *acAutomaton
+	htmlMeta []acMeta
 
-	// HTML
-	dqHtmlMatch := []byte("\"/")
-	sqHtmlMatch := []byte("'/")
+	xmlOnce sync.Once
+	xmlAC   *acAutomaton
+	xmlMeta []acMeta
+}
 
-	dqGuard := []byte("\"//")
-	sqGuard := []byte("'//")
+func newAbsurlReplacer(cfg AbsURLConfig) *absurlReplacer {
+	attrs := cfg.Attrs
+	if len(attrs) == 0 {
+		attrs = DefaultRewriteAttrs
+	}
 
-	// XML
-	dqXmlMatch := []byte("&#34;/")
-	sqXmlMatch := []byte("&#39;/")
+	u, _ := url.Parse(cfg.BaseURL)
+	base := strings.TrimRight(u.String(), "/")
+	protoRelBase := "//" + strings.TrimPrefix(base, u.Scheme+"://")
 
-	dqXmlGuard := []byte("&#34;//")
-	sqXmlGuard := []byte("&#39;//")
+	canonicalOK := true
+	if cfg.Mode == RewriteModeCanonical && cfg.CanonicalURL != "" {
+		cu, _ := url.Parse(cfg.CanonicalURL)
+		canonicalOK = strings.EqualFold(cu.Host, u.Host)
+	}
 
-	dqHtml := []byte("\"" + base + "/")
-	sqHtml := []byte("'" + base + "/")
+	rewriteBase := replacementBase(base, protoRelBase, cfg.Mode, canonicalOK)
+
+	var htmlMatchers, xmlMatchers []absurlMatcher
+	for _, name := range attrs {
+		multiVal := multiValAttrs[name]
+
+		htmlMatchers = append(htmlMatchers,
+			newMatcher(name, `"`, rewriteBase, '"', multiVal),
+			newMatcher(name, `'`, rewriteBase, '\'', multiVal),
+		)
+
+		// XML (RSS/sitemap) attribute values are entity-encoded by the
+		// templates that produce them, so the quote is the multi-byte
+		// entity &#34;/&#39; rather than a literal quote byte. srcset
+		// doesn't occur in that content, so multiVal never applies here.
+		xmlMatchers = append(xmlMatchers,
+			newMatcher(name, "&#34;", rewriteBase, 0, false),
+			newMatcher(name, "&#39;", rewriteBase, 0, false),
+		)
+	}
 
-	dqXml := []byte("&#34;" + base + "/")
-	sqXml := []byte("&#39;" + base + "/")
+	return &absurlReplacer{htmlMatchers: htmlMatchers, xmlMatchers: xmlMatchers}
+}
 
-	return &absurlReplacer{htmlMatchers: []absurlMatcher{
-		{tSrcdq, tGrcdq, dqHtmlMatch, dqGuard, dqHtml, false},
-		{tSrcsq, tGsrcsq, sqHtmlMatch, sqGuard, sqHtml, false},
-		{tHrefdq, tGhrefdq, dqHtmlMatch, dqGuard, dqHtml, false},
-		{tHrefsq, tGhrefsq, sqHtmlMatch, sqGuard, sqHtml, false}},
-		xmlMatchers: []absurlMatcher{
-			{tSrcdq, tGrcdq, dqXmlMatch, dqXmlGuard, dqXml, false},
-			{tSrcsq, tGsrcsq, sqXmlMatch, sqXmlGuard, sqXml, false},
-			{tHrefdq, tGhrefdq, dqXmlMatch, dqXmlGuard, dqXml, false},
-			{tHrefsq, tGhrefsq, sqXmlMatch, sqXmlGuard, sqXml, false},
-		}}
+// newMatcher builds the absurlMatcher for one (attribute, quote) pair. Its
+// patterns start with the space before the attribute name, so an attribute
+// whose name merely ends in attr (data-src for src) is not matched.
+func newMatcher(attr, quoteSeq, base string, quoteByte byte, multiVal bool) absurlMatcher {
+	return absurlMatcher{
+		match:            []byte(" " + attr + "=" + quoteSeq + "/"),
+		guard:            []byte(" " + attr + "=" + quoteSeq + "//"),
+		replacement:      []byte(" " + attr + "=" + quoteSeq + base + "/"),
+		valueReplacement: []byte(base + "/"),
+		quote:            quoteByte,
+		multiVal:         multiVal,
+	}
+}
 
+// replacementBase returns the base URL a matched root-relative candidate
+// should be rewritten against for the given mode, or "" when
+// RewriteModeCanonical determined this rendering shouldn't absolutify its
+// root-relative URLs at all (the candidate is then left untouched).
+func replacementBase(base, protoRelBase string, mode RewriteMode, canonicalOK bool) string {
+	switch mode {
+	case RewriteModeProtocolRelative:
+		return protoRelBase
+	case RewriteModeCanonical:
+		if canonicalOK {
+			return base
+		}
+		return ""
+	default:
+		return base
+	}
 }
 
 func (au *absurlReplacer) replaceInHtml(content []byte) []byte {
-	return doReplace(content, au.htmlMatchers)
+	au.htmlOnce.Do(func() {
+		au.htmlAC, au.htmlMeta = buildMatcherAC(au.htmlMatchers)
+	})
+	return acReplace(content, au.htmlMatchers, au.htmlAC, au.htmlMeta)
+}
+
+// newHTMLStream returns a fresh, resumable scan over the replacer's HTML
+// matchers, for callers (such as absURLTransformer) that feed content in
+// bounded chunks rather than all at once.
+func (au *absurlReplacer) newHTMLStream() *streamReplacer {
+	au.htmlOnce.Do(func() {
+		au.htmlAC, au.htmlMeta = buildMatcherAC(au.htmlMatchers)
+	})
+	return newStreamReplacer(au.htmlMatchers, au.htmlAC, au.htmlMeta, au.maxPatternLen())
 }
 
 func (au *absurlReplacer) replaceInXml(content []byte) []byte {
-	return doReplace(content, au.xmlMatchers)
+	au.xmlOnce.Do(func() {
+		au.xmlAC, au.xmlMeta = buildMatcherAC(au.xmlMatchers)
+	})
+	return acReplace(content, au.xmlMatchers, au.xmlAC, au.xmlMeta)
+}
+
+// maxPatternLen returns the length, in bytes, of the longest guard
+// literal among the replacer's HTML and XML matchers (a guard is always
+// longer than its match). Apply holds back this many trailing bytes at a
+// chunk boundary, which is enough to guarantee it never splits a
+// candidate match across two chunks.
+func (au *absurlReplacer) maxPatternLen() int {
+	max := 0
+	for _, matchers := range [][]absurlMatcher{au.htmlMatchers, au.xmlMatchers} {
+		for _, m := range matchers {
+			if l := len(m.guard); l > max {
+				max = l
+			}
+		}
+	}
+	return max
+}
+
+// Transformer rewrites rendered output before it reaches its final
+// destination, e.g. absolutizing root-relative URLs.
+type Transformer interface {
+	// Apply reads content from r, rewrites it, and writes the result to
+	// w. Implementations stream the input in bounded-size chunks rather
+	// than buffering it fully, so large pages don't double memory.
+	Apply(w io.Writer, r io.Reader) error
+}
+
+// transformChunkSize is the size Apply reads from its io.Reader at a
+// time. It's arbitrary beyond being comfortably larger than any
+// holdback window a configured absurlReplacer can produce.
+const transformChunkSize = 32 * 1024
+
+// absURLTransformer streams content through an absurlReplacer using a
+// resumable streamReplacer, so a match, guard, or multiVal candidate
+// that straddles a chunk boundary is still recognized correctly.
+type absURLTransformer struct {
+	replacer *absurlReplacer
+}
+
+// NewAbsURLTransformer returns a Transformer that absolutizes
+// root-relative URLs in HTML content against baseURL.
+func NewAbsURLTransformer(baseURL string) Transformer {
+	return newAbsURLTransformer(AbsURLConfig{BaseURL: baseURL})
+}
+
+func newAbsURLTransformer(cfg AbsURLConfig) *absURLTransformer {
+	return &absURLTransformer{replacer: newAbsurlReplacer(cfg)}
+}
+
+func (t *absURLTransformer) Apply(w io.Writer, r io.Reader) error {
+	s := t.replacer.newHTMLStream()
+	buf := make([]byte, transformChunkSize)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := s.write(w, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF {
+			return s.close(w)
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
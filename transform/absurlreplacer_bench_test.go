@@ -0,0 +1,44 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+)
+
+// benchHTMLFixture builds a synthetic HTML page of roughly the given size
+// in bytes, repeating a block of tags that exercise every matcher kind
+// (absolute, protocol-relative, root-relative, srcset, and an attribute
+// that never matches) so the benchmark reflects realistic matcher
+// contention, not just a single pattern.
+func benchHTMLFixture(size int) string {
+	const block = `<p>Some text around a <a href="/about/">link</a> and an
+<img src="/img/a.jpg" srcset="/img/a.jpg 1x, /img/a-2x.jpg 2x" alt="pic">
+and an already-absolute <a href="http://other.example.com/x">external link</a>
+and an already protocol-relative <script src="//cdn.example.com/app.js"></script>
+</p>
+`
+	var b strings.Builder
+	for b.Len() < size {
+		b.WriteString(block)
+	}
+	return b.String()
+}
+
+func BenchmarkAbsURLReplaceInHtml1MB(b *testing.B) {
+	content := []byte(benchHTMLFixture(1 << 20))
+	replacer := newAbsurlReplacer(AbsURLConfig{
+		BaseURL: "http://example.com/blog",
+		Attrs:   []string{"src", "href", "srcset"},
+	})
+
+	// Warm the lazily-built automaton outside the timed loop, matching
+	// how a long-lived site build reuses one absurlReplacer per output
+	// format rather than rebuilding it per page.
+	replacer.replaceInHtml(content)
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replacer.replaceInHtml(content)
+	}
+}
@@ -0,0 +1,131 @@
+package transform
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// splitReader hands its data back in two reads: the first split bytes,
+// then the remainder. It's used to force a chunk boundary at an
+// arbitrary position without depending on transformChunkSize.
+type splitReader struct {
+	data  []byte
+	split int
+	first bool
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n := len(r.data)
+	if !r.first {
+		r.first = true
+		if r.split < n {
+			n = r.split
+		}
+	}
+
+	copied := copy(p, r.data[:n])
+	r.data = r.data[copied:]
+	return copied, nil
+}
+
+func TestReplaceInHtml(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  AbsURLConfig
+		in   string
+		want string
+	}{
+		{
+			name: "default attrs only rewrite src and href",
+			cfg:  AbsURLConfig{BaseURL: "http://example.com/blog"},
+			in:   `<img src="/a.jpg" poster="/b.jpg"><a href="/p">x</a>`,
+			want: `<img src="http://example.com/blog/a.jpg" poster="/b.jpg"><a href="http://example.com/blog/p">x</a>`,
+		},
+		{
+			name: "configured attrs extend rewriting to poster",
+			cfg:  AbsURLConfig{BaseURL: "http://example.com/blog", Attrs: []string{"src", "href", "poster"}},
+			in:   `<img src="/a.jpg" poster="/b.jpg">`,
+			want: `<img src="http://example.com/blog/a.jpg" poster="http://example.com/blog/b.jpg">`,
+		},
+		{
+			name: "protocol-relative mode",
+			cfg:  AbsURLConfig{BaseURL: "http://example.com/blog", Mode: RewriteModeProtocolRelative},
+			in:   `<img src="/a.jpg">`,
+			want: `<img src="//example.com/blog/a.jpg">`,
+		},
+		{
+			name: "canonical mode rewrites when base and canonical share a host",
+			cfg: AbsURLConfig{
+				BaseURL:      "http://example.com/blog",
+				CanonicalURL: "http://example.com/",
+				Mode:         RewriteModeCanonical,
+			},
+			in:   `<img src="/a.jpg">`,
+			want: `<img src="http://example.com/blog/a.jpg">`,
+		},
+		{
+			name: "canonical mode leaves root-relative URLs untouched for a different host",
+			cfg: AbsURLConfig{
+				BaseURL:      "http://example.com/blog",
+				CanonicalURL: "http://other.example.com/",
+				Mode:         RewriteModeCanonical,
+			},
+			in:   `<img src="/a.jpg">`,
+			want: `<img src="/a.jpg">`,
+		},
+		{
+			name: "srcset rewrites every candidate in the list",
+			cfg:  AbsURLConfig{BaseURL: "http://example.com/blog", Attrs: []string{"src", "href", "srcset"}},
+			in:   `<img src="/a.jpg" srcset="/a.jpg 1x, /b.jpg 2x">`,
+			want: `<img src="http://example.com/blog/a.jpg" srcset="http://example.com/blog/a.jpg 1x, http://example.com/blog/b.jpg 2x">`,
+		},
+		{
+			name: "already absolute or protocol-relative URLs are left untouched",
+			cfg:  AbsURLConfig{BaseURL: "http://example.com/blog"},
+			in:   `<a href="http://other.com/x"><a href="//cdn.example.com/y">`,
+			want: `<a href="http://other.com/x"><a href="//cdn.example.com/y">`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacer := newAbsurlReplacer(tt.cfg)
+			got := replacer.replaceInHtml([]byte(tt.in))
+			if string(got) != tt.want {
+				t.Errorf("replaceInHtml(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzAbsURLTransformerChunkBoundary(f *testing.F) {
+	f.Add([]byte(`<img src="/a.jpg" srcset="/a.jpg 1x, /b.jpg 2x"><a href='/p'>x</a>`), uint8(17))
+	f.Add([]byte(`<a href="http://other.com/x"><a href="//cdn.example.com/y">`), uint8(0))
+
+	f.Fuzz(func(t *testing.T, content []byte, splitAt uint8) {
+		replacer := newAbsurlReplacer(AbsURLConfig{BaseURL: "http://example.com/blog"})
+		want := replacer.replaceInHtml(content)
+
+		split := int(splitAt)
+		if split > len(content) {
+			split = len(content)
+		}
+
+		transformer := newAbsURLTransformer(AbsURLConfig{BaseURL: "http://example.com/blog"})
+
+		var got bytes.Buffer
+		r := &splitReader{data: content, split: split}
+		if err := transformer.Apply(&got, r); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("chunked output differs from whole-buffer output at split=%d\n got: %q\nwant: %q", split, got.Bytes(), want)
+		}
+	})
+}